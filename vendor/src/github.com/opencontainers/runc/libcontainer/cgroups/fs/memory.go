@@ -54,6 +54,12 @@ func (s *MemoryGroup) Apply(d *cgroupData) (err error) {
 		}
 	}()
 
+	if !s.supportV2 && path != "" {
+		if err = primeKernelMemoryAccounting(path, d.config.Resources); err != nil {
+			return err
+		}
+	}
+
 	// We need to join memory cgroup after set memory limits, because
 	// kmem.limit_in_bytes can only be set when the cgroup is empty.
 	_, err = d.join("memory")
@@ -65,14 +71,8 @@ func (s *MemoryGroup) Apply(d *cgroupData) (err error) {
 }
 
 func (s *MemoryGroup) Set(path string, cgroup *configs.Cgroup) error {
-	if cgroup.Resources.Memory != 0 {
-		name := "memory.limit_in_bytes"
-		if s.supportV2 {
-			name = "memory.max"
-		}
-		if err := writeFile(path, name, strconv.FormatInt(cgroup.Resources.Memory, 10)); err != nil {
-			return err
-		}
+	if err := s.setMemoryAndSwap(path, cgroup); err != nil {
+		return err
 	}
 
 	if cgroup.Resources.MemoryReservation != 0 {
@@ -85,26 +85,26 @@ func (s *MemoryGroup) Set(path string, cgroup *configs.Cgroup) error {
 		}
 	}
 
-	if cgroup.Resources.MemorySwap > 0 {
-		name := "memory.memsw.limit_in_bytes"
-		if s.supportV2 {
-			name = "memory.swap.max"
-		}
-		if err := writeFile(path, name, strconv.FormatInt(cgroup.Resources.MemorySwap, 10)); err != nil {
-			return err
-		}
-	}
-
 	if s.supportV2 {
 		return nil
 	}
 
 	if cgroup.Resources.KernelMemory > 0 {
+		// Unlike the priming writes in primeKernelMemoryAccounting, this
+		// is a limit the caller explicitly asked for: propagate any
+		// error instead of swallowing it, or a request like
+		// --kernel-memory=100m would silently go unenforced.
 		if err := writeFile(path, "memory.kmem.limit_in_bytes", strconv.FormatInt(cgroup.Resources.KernelMemory, 10)); err != nil {
 			return err
 		}
 	}
 
+	if cgroup.Resources.KernelMemoryTCP > 0 {
+		if err := writeFile(path, "memory.kmem.tcp.limit_in_bytes", strconv.FormatInt(cgroup.Resources.KernelMemoryTCP, 10)); err != nil {
+			return err
+		}
+	}
+
 	if cgroup.Resources.OomKillDisable {
 		if err := writeFile(path, "memory.oom_control", "1"); err != nil {
 			return err
@@ -124,6 +124,190 @@ func (s *MemoryGroup) Set(path string, cgroup *configs.Cgroup) error {
 	return nil
 }
 
+// setMemoryAndSwap writes cgroup.Resources.Memory and MemorySwap (or
+// their v2 equivalents). The two limits are cross-validated by the
+// kernel: memory.limit_in_bytes cannot be raised above the memsw limit
+// currently in effect, and memory.memsw.limit_in_bytes cannot be
+// lowered below the memory limit currently in effect. When both are
+// being updated at once, writing them in the wrong order fails with
+// EINVAL, so read what's currently effective and pick an order that
+// will succeed.
+func (s *MemoryGroup) setMemoryAndSwap(path string, cgroup *configs.Cgroup) error {
+	if s.supportV2 {
+		return s.setMemoryAndSwapV2(path, cgroup)
+	}
+	return s.setMemoryAndSwapV1(path, cgroup)
+}
+
+func (s *MemoryGroup) setMemoryAndSwapV1(path string, cgroup *configs.Cgroup) error {
+	memory := cgroup.Resources.Memory
+	swap := cgroup.Resources.MemorySwap
+
+	if memory == 0 && swap == 0 {
+		return nil
+	}
+
+	curMemory, err := getCgroupParamUint(path, "memory.limit_in_bytes")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	curSwap, err := getCgroupParamUint(path, "memory.memsw.limit_in_bytes")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	writeMemory := func() error {
+		return writeFile(path, "memory.limit_in_bytes", strconv.FormatInt(memory, 10))
+	}
+	writeSwap := func() error {
+		return writeFile(path, "memory.memsw.limit_in_bytes", strconv.FormatInt(swap, 10))
+	}
+
+	// Growing memory past the swap limit in effect, or shrinking swap
+	// below the memory limit in effect, must write the other value
+	// first so neither write is ever rejected for being out of range
+	// of its stale counterpart. Only include the limits that are
+	// actually being changed in the order: a limit left at 0 means
+	// "leave it alone", and must never be treated as a (trivially
+	// succeeding) write when deciding what runs first.
+	swapFirst := memory != 0 && curSwap != 0 && memory > int64(curSwap)
+	if swap > 0 && curMemory != 0 && swap < int64(curMemory) {
+		swapFirst = false
+	}
+
+	var writes []func() error
+	if swapFirst {
+		if swap != 0 {
+			writes = append(writes, writeSwap)
+		}
+		if memory != 0 {
+			writes = append(writes, writeMemory)
+		}
+	} else {
+		if memory != 0 {
+			writes = append(writes, writeMemory)
+		}
+		if swap != 0 {
+			writes = append(writes, writeSwap)
+		}
+	}
+
+	for _, write := range writes {
+		if err := write(); err == nil {
+			continue
+		} else if !isWriteEINVAL(err) {
+			return err
+		} else {
+			// The kernel rejected our ordering (e.g. both limits are
+			// shrinking against each other). Set both to unlimited
+			// first, then grow into the requested values, which can
+			// never fail since nothing is shrinking against a stale
+			// peer anymore.
+			if err := writeFile(path, "memory.memsw.limit_in_bytes", "-1"); err != nil {
+				return err
+			}
+			if err := writeFile(path, "memory.limit_in_bytes", "-1"); err != nil {
+				return err
+			}
+			if memory != 0 {
+				if err := writeMemory(); err != nil {
+					return err
+				}
+			}
+			if swap != 0 {
+				if err := writeSwap(); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *MemoryGroup) setMemoryAndSwapV2(path string, cgroup *configs.Cgroup) error {
+	memory := cgroup.Resources.Memory
+	swap := cgroup.Resources.MemorySwap
+
+	if memory != 0 {
+		if err := writeFile(path, "memory.max", strconv.FormatInt(memory, 10)); err != nil {
+			return err
+		}
+	}
+
+	if swap == 0 {
+		return nil
+	}
+	if swap == -1 {
+		return writeFile(path, "memory.swap.max", "max")
+	}
+	if memory != 0 && swap < memory {
+		return fmt.Errorf("memory+swap limit (%d) cannot be less than memory limit (%d)", swap, memory)
+	}
+
+	// memory.swap.max on the unified hierarchy is swap-only, unlike the
+	// v1 memsw limit which accounts for memory+swap, so the value
+	// written is the swap-only delta between the two.
+	swapOnly := swap
+	if memory > 0 {
+		swapOnly = swap - memory
+	}
+	return writeFile(path, "memory.swap.max", strconv.FormatInt(swapOnly, 10))
+}
+
+// isWriteEINVAL reports whether err came from the kernel rejecting a
+// cgroupfs write with EINVAL, as opposed to e.g. a missing file.
+func isWriteEINVAL(err error) bool {
+	return strings.Contains(err.Error(), "invalid argument")
+}
+
+// primeKernelMemoryAccounting ensures memory.kmem.limit_in_bytes and
+// memory.kmem.tcp.limit_in_bytes have each been written at least once
+// before any tasks join the cgroup: the kernel only starts accounting
+// kmem (or kmem TCP) usage once the corresponding file has been set,
+// and refuses to change it at all on a non-empty cgroup. If the caller
+// configured an explicit limit for one, Set already wrote it and there
+// is nothing to prime for that one.
+func primeKernelMemoryAccounting(path string, r *configs.Resources) error {
+	if r.KernelMemory == 0 {
+		if err := primeKmemFile(path, "memory.kmem.limit_in_bytes"); err != nil {
+			return err
+		}
+	}
+	if r.KernelMemoryTCP == 0 {
+		if err := primeKmemFile(path, "memory.kmem.tcp.limit_in_bytes"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// primeKmemFile writes "1" and then "-1" to a memory.kmem.* limit file,
+// turning its accounting on without imposing any limit.
+func primeKmemFile(path, file string) error {
+	if err := writeKmemFile(path, file, "1"); err != nil {
+		return err
+	}
+	return writeKmemFile(path, file, "-1")
+}
+
+// writeKmemFile writes to a memory.kmem.* control file, tolerating the
+// ways a kernel can refuse kmem accounting altogether: EBUSY means the
+// cgroup already has tasks (or was already primed), and ENOENT/ENOTSUP
+// mean the kernel was built without CONFIG_MEMCG_KMEM. Any other error
+// is propagated.
+func writeKmemFile(path, file, value string) error {
+	err := writeFile(path, file, value)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "device or resource busy") || strings.Contains(msg, "not supported") {
+		return nil
+	}
+	return err
+}
+
 func (s *MemoryGroup) Remove(d *cgroupData) error {
 	path, err := d.path("memory")
 	if cgroups.IsV2Error(err) {
@@ -172,7 +356,7 @@ func (s *MemoryGroup) GetStats(path string, stats *cgroups.Stats) error {
 	stats.MemoryStats.SwapUsage = swapUsage
 
 	if s.supportV2 {
-		return nil
+		return s.getStatsV2(path, stats)
 	}
 
 	kernelUsage, err := s.getMemoryData(path, "kmem")
@@ -181,14 +365,130 @@ func (s *MemoryGroup) GetStats(path string, stats *cgroups.Stats) error {
 	}
 	stats.MemoryStats.KernelUsage = kernelUsage
 
+	oomKillCount, err := s.OOMKillCount(path)
+	if err != nil {
+		return err
+	}
+	stats.MemoryStats.OOMKillCount = oomKillCount
+
+	return nil
+}
+
+// getStatsV2 fills in the portions of stats.MemoryStats that only the
+// unified hierarchy exposes: the low/high/max/oom/oom_kill counters
+// from memory.events (and, when present, the per-cgroup-only
+// memory.events.local), plus the memory.stat fields v2 adds over v1.
+// Missing files degrade to zero values rather than erroring, since
+// availability depends on the running kernel version.
+func (s *MemoryGroup) getStatsV2(path string, stats *cgroups.Stats) error {
+	events, err := parseMemoryEvents(path, "memory.events")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	stats.MemoryStats.MemoryEvents = cgroups.MemoryEvents{
+		Low:     events["low"],
+		High:    events["high"],
+		Max:     events["max"],
+		OOM:     events["oom"],
+		OOMKill: events["oom_kill"],
+	}
+	stats.MemoryStats.OOMKillCount = events["oom_kill"]
+
+	localEvents, err := parseMemoryEvents(path, "memory.events.local")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	stats.MemoryStats.MemoryEventsLocal = cgroups.MemoryEvents{
+		Low:     localEvents["low"],
+		High:    localEvents["high"],
+		Max:     localEvents["max"],
+		OOM:     localEvents["oom"],
+		OOMKill: localEvents["oom_kill"],
+	}
+
+	st := stats.MemoryStats.Stats
+	stats.MemoryStats.Anon = st["anon"]
+	stats.MemoryStats.File = st["file"]
+	stats.MemoryStats.KernelStack = st["kernel_stack"]
+	stats.MemoryStats.Slab = st["slab"]
+	stats.MemoryStats.Sock = st["sock"]
+	stats.MemoryStats.Shmem = st["shmem"]
+	stats.MemoryStats.Pgfault = st["pgfault"]
+	stats.MemoryStats.Pgmajfault = st["pgmajfault"]
+	stats.MemoryStats.WorkingsetRefault = st["workingset_refault"]
+	stats.MemoryStats.WorkingsetActivate = st["workingset_activate"]
+
 	return nil
 }
 
+// OOMKillCount returns the number of times the kernel OOM killer has
+// reaped a task inside the cgroup at path. It is safe to call
+// repeatedly; the returned value is monotonically increasing for the
+// lifetime of the cgroup.
+func (s *MemoryGroup) OOMKillCount(path string) (uint64, error) {
+	if s.supportV2 {
+		events, err := parseMemoryEvents(path, "memory.events")
+		if err != nil {
+			if os.IsNotExist(err) {
+				return 0, nil
+			}
+			return 0, err
+		}
+		return events["oom_kill"], nil
+	}
+
+	f, err := os.Open(filepath.Join(path, "memory.oom_control"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Kernel predates oom_kill accounting; report no kills
+			// rather than failing the whole stats collection.
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		t, v, err := getCgroupParamKeyValue(sc.Text())
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse memory.oom_control (%q)  %v", sc.Text(), err)
+		}
+		if t == "oom_kill" {
+			return v, nil
+		}
+	}
+	// Some older kernels expose oom_control without an oom_kill field.
+	return 0, nil
+}
+
+// parseMemoryEvents reads a cgroup v2 "key value" events file such as
+// memory.events or memory.events.local and returns the parsed counters.
+func parseMemoryEvents(path, file string) (map[string]uint64, error) {
+	f, err := os.Open(filepath.Join(path, file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	events := make(map[string]uint64)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		t, v, err := getCgroupParamKeyValue(sc.Text())
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s (%q)  %v", file, sc.Text(), err)
+		}
+		events[t] = v
+	}
+	return events, nil
+}
+
 func memoryAssigned(cgroup *configs.Cgroup) bool {
 	return cgroup.Resources.Memory != 0 ||
 		cgroup.Resources.MemoryReservation != 0 ||
 		cgroup.Resources.MemorySwap > 0 ||
 		cgroup.Resources.KernelMemory > 0 ||
+		cgroup.Resources.KernelMemoryTCP > 0 ||
 		cgroup.Resources.OomKillDisable ||
 		cgroup.Resources.MemorySwappiness != 1
 }
@@ -0,0 +1,342 @@
+// +build linux
+
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OOMEvent describes a single kernel OOM kill observed inside a memory
+// cgroup. VictimPID and VictimComm are best-effort: they come from
+// scraping /dev/kmsg for the kernel's own OOM kill log line and are
+// left zero/empty when that line can't be found or the log can't be
+// read.
+type OOMEvent struct {
+	Timestamp  time.Time
+	KillCount  uint64
+	VictimPID  int
+	VictimComm string
+}
+
+// kmsgLookbackLines bounds how many /dev/kmsg records a single victim
+// scan will read, so a noisy kernel log can't make victim
+// identification block or run unbounded. Since the reader fd's
+// position is seeked to the tail once at registration and then never
+// rewound, this only needs to cover records logged since the last
+// scan, not the whole ring.
+const kmsgLookbackLines = 2048
+
+type oomNotifier struct {
+	events chan OOMEvent
+	stopFd int
+	fds    []int
+	// ctrlFile is memory.oom_control (v1) or memory.events (v2): kept
+	// open via the *os.File (not just its bare fd) so the GC finalizer
+	// never closes it while it's still in use - on v1 as the target of
+	// the eventfd registration, on v2 as the fd epfd watches.
+	ctrlFile *os.File
+	kmsgFd   int // -1 if /dev/kmsg couldn't be opened; victim ID degrades to zero values
+	once     sync.Once
+	wg       sync.WaitGroup
+	dropped  uint64
+}
+
+// Dropped returns the number of events that could not be delivered
+// because the consumer wasn't receiving from the channel at the
+// instant they were produced.
+func (n *oomNotifier) Dropped() uint64 {
+	return atomic.LoadUint64(&n.dropped)
+}
+
+// Close stops the watch goroutine and waits for it to exit, then
+// closes every fd it owns (including the kmsg fd) and the event
+// channel. A kmsg victim scan already in progress is not interrupted:
+// it runs to completion (its reads are non-blocking and bounded by
+// kmsgLookbackLines) before Close returns. It is safe to call more
+// than once.
+func (n *oomNotifier) Close() error {
+	n.once.Do(func() {
+		buf := make([]byte, 8)
+		buf[0] = 1
+		unix.Write(n.stopFd, buf)
+		n.wg.Wait()
+		for _, fd := range n.fds {
+			unix.Close(fd)
+		}
+		if n.ctrlFile != nil {
+			n.ctrlFile.Close()
+		}
+		if n.kmsgFd >= 0 {
+			unix.Close(n.kmsgFd)
+		}
+		close(n.events)
+	})
+	return nil
+}
+
+// openKmsgTail opens /dev/kmsg non-blocking and seeks to the end of
+// the ring, so all subsequent reads on the returned fd only ever
+// return records logged after this call - never records from the
+// head of the ring. Without this, a long-lived host with a full kmsg
+// ring would make every victim scan restart from the oldest record
+// and exhaust its lookback budget before reaching the kill that was
+// just logged. Returns -1 if /dev/kmsg can't be opened or seeked;
+// victim identification then degrades to zero values. A raw fd is
+// used (rather than *os.File) so nothing closes it via finalizer out
+// from under the notifier while it's still held in kmsgFd.
+func openKmsgTail() int {
+	fd, err := unix.Open("/dev/kmsg", unix.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return -1
+	}
+	if _, err := unix.Seek(fd, 0, io.SeekEnd); err != nil {
+		unix.Close(fd)
+		return -1
+	}
+	return fd
+}
+
+// OOMEventStream starts watching the memory cgroup at path for kernel
+// OOM kills and returns a channel of OOMEvent plus a Closer that stops
+// the watch. This replaces the ad-hoc oom_control/eventfd watching
+// callers previously had to implement for themselves.
+func (s *MemoryGroup) OOMEventStream(path string) (<-chan OOMEvent, io.Closer, error) {
+	if s.supportV2 {
+		return registerOOMStreamV2(path)
+	}
+	return registerOOMStreamV1(path)
+}
+
+func registerOOMStreamV1(path string) (<-chan OOMEvent, io.Closer, error) {
+	controlFile, err := os.Open(filepath.Join(path, "memory.oom_control"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eventFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		controlFile.Close()
+		return nil, nil, err
+	}
+
+	config := fmt.Sprintf("%d %d", eventFd, controlFile.Fd())
+	if err := writeFile(path, "cgroup.event_control", config); err != nil {
+		unix.Close(eventFd)
+		controlFile.Close()
+		return nil, nil, fmt.Errorf("failed to register oom eventfd: %v", err)
+	}
+
+	epfd, stopFd, err := newEpollWithStop(eventFd, unix.EPOLLIN)
+	if err != nil {
+		unix.Close(eventFd)
+		controlFile.Close()
+		return nil, nil, err
+	}
+
+	kmsgFd := openKmsgTail()
+
+	n := &oomNotifier{
+		events:   make(chan OOMEvent, 1),
+		stopFd:   stopFd,
+		fds:      []int{epfd, stopFd, eventFd},
+		ctrlFile: controlFile,
+		kmsgFd:   kmsgFd,
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		var kills uint64
+		buf := make([]byte, 8)
+		epollLoop(epfd, eventFd, stopFd, func() {
+			unix.Read(eventFd, buf)
+			kills++
+			pid, comm := scanKmsgForVictim(kmsgFd, path)
+			select {
+			case n.events <- OOMEvent{Timestamp: time.Now(), KillCount: kills, VictimPID: pid, VictimComm: comm}:
+			default:
+				atomic.AddUint64(&n.dropped, 1)
+			}
+		})
+	}()
+
+	return n.events, n, nil
+}
+
+func registerOOMStreamV2(path string) (<-chan OOMEvent, io.Closer, error) {
+	f, err := os.Open(filepath.Join(path, "memory.events"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := uint64(0)
+	if events, err := parseMemoryEvents(path, "memory.events"); err == nil {
+		last = events["oom_kill"]
+	}
+
+	epfd, stopFd, err := newEpollWithStop(int(f.Fd()), unix.EPOLLPRI)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	kmsgFd := openKmsgTail()
+
+	n := &oomNotifier{
+		events:   make(chan OOMEvent, 1),
+		stopFd:   stopFd,
+		fds:      []int{epfd, stopFd},
+		ctrlFile: f,
+		kmsgFd:   kmsgFd,
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		epollLoop(epfd, int(f.Fd()), stopFd, func() {
+			events, err := parseMemoryEvents(path, "memory.events")
+			if err != nil {
+				return
+			}
+			cur := events["oom_kill"]
+			if cur <= last {
+				return
+			}
+			last = cur
+			pid, comm := scanKmsgForVictim(kmsgFd, path)
+			select {
+			case n.events <- OOMEvent{Timestamp: time.Now(), KillCount: cur, VictimPID: pid, VictimComm: comm}:
+			default:
+				atomic.AddUint64(&n.dropped, 1)
+			}
+		})
+	}()
+
+	return n.events, n, nil
+}
+
+// newEpollWithStop creates an epoll instance watching watchFd for
+// watchEvents, plus a dedicated stop eventfd so Close can unblock the
+// epoll_wait loop without racing the fd being watched.
+func newEpollWithStop(watchFd int, watchEvents uint32) (epfd, stopFd int, err error) {
+	epfd, err = unix.EpollCreate1(0)
+	if err != nil {
+		return -1, -1, err
+	}
+	if err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, watchFd, &unix.EpollEvent{Events: watchEvents, Fd: int32(watchFd)}); err != nil {
+		unix.Close(epfd)
+		return -1, -1, err
+	}
+	stopFd, err = unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(epfd)
+		return -1, -1, err
+	}
+	if err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, stopFd, &unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(stopFd)}); err != nil {
+		unix.Close(stopFd)
+		unix.Close(epfd)
+		return -1, -1, err
+	}
+	return epfd, stopFd, nil
+}
+
+// epollLoop waits on epfd until either watchFd is ready (invoking
+// onReady) or stopFd is signaled, at which point it returns.
+func epollLoop(epfd, watchFd, stopFd int, onReady func()) {
+	events := make([]unix.EpollEvent, 2)
+	for {
+		nev, err := unix.EpollWait(epfd, events, -1)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return
+		}
+		stop := false
+		ready := false
+		for i := 0; i < nev; i++ {
+			switch int(events[i].Fd) {
+			case stopFd:
+				stop = true
+			case watchFd:
+				ready = true
+			}
+		}
+		if ready {
+			onReady()
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// scanKmsgForVictim does a bounded, best-effort scan of kmsgFd (a
+// /dev/kmsg fd previously positioned by openKmsgTail) for the "Memory
+// cgroup out of memory" line the kernel itself logs when it kills a
+// task, looking for one whose cgroup path matches ours. It degrades
+// silently (returning zero values) when kmsgFd is -1, the read fails,
+// or no matching line turns up within the lookback bound - since the
+// fd only ever advances forward, a miss here just means the scan
+// needs to keep pace with new records, not restart from the ring head.
+func scanKmsgForVictim(kmsgFd int, cgroupPath string) (pid int, comm string) {
+	if kmsgFd < 0 {
+		return 0, ""
+	}
+
+	buf := make([]byte, 8192)
+	for i := 0; i < kmsgLookbackLines; i++ {
+		n, err := unix.Read(kmsgFd, buf)
+		if err != nil || n <= 0 {
+			break
+		}
+		line := string(buf[:n])
+		if !strings.Contains(line, "Memory cgroup out of memory:") || !strings.Contains(line, cgroupPath) {
+			continue
+		}
+		if p, c, ok := parseOOMVictim(line); ok {
+			pid, comm = p, c
+		}
+	}
+	return pid, comm
+}
+
+// parseOOMVictim extracts the pid and command name from a kernel OOM
+// kill log line of the form:
+//
+//	Memory cgroup out of memory: Killed process 1234 (myapp) total-vm:...
+func parseOOMVictim(line string) (pid int, comm string, ok bool) {
+	const marker = "Killed process "
+	idx := strings.Index(line, marker)
+	if idx < 0 {
+		return 0, "", false
+	}
+	rest := line[idx+len(marker):]
+	sp := strings.IndexByte(rest, ' ')
+	if sp < 0 {
+		return 0, "", false
+	}
+	p, err := strconv.Atoi(rest[:sp])
+	if err != nil {
+		return 0, "", false
+	}
+	rest = rest[sp+1:]
+	if rest == "" || rest[0] != '(' {
+		return p, "", true
+	}
+	end := strings.IndexByte(rest, ')')
+	if end < 0 {
+		return p, "", true
+	}
+	return p, rest[1:end], true
+}
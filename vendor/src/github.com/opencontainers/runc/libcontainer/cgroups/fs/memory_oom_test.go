@@ -0,0 +1,64 @@
+// +build linux
+
+package fs
+
+import "testing"
+
+func TestParseOOMVictim(t *testing.T) {
+	cases := []struct {
+		name     string
+		line     string
+		wantPID  int
+		wantComm string
+		wantOK   bool
+	}{
+		{
+			name:     "well-formed kill line",
+			line:     "Memory cgroup out of memory: Killed process 1234 (myapp) total-vm:123456kB, anon-rss:1024kB",
+			wantPID:  1234,
+			wantComm: "myapp",
+			wantOK:   true,
+		},
+		{
+			name:     "comm missing trailing fields still parses pid",
+			line:     "Memory cgroup out of memory: Killed process 42 (sh)",
+			wantPID:  42,
+			wantComm: "sh",
+			wantOK:   true,
+		},
+		{
+			name:   "no marker",
+			line:   "some unrelated kernel log line",
+			wantOK: false,
+		},
+		{
+			name:   "marker without a pid",
+			line:   "Memory cgroup out of memory: Killed process ",
+			wantOK: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pid, comm, ok := parseOOMVictim(c.line)
+			if ok != c.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, c.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if pid != c.wantPID || comm != c.wantComm {
+				t.Errorf("got (%d, %q), want (%d, %q)", pid, comm, c.wantPID, c.wantComm)
+			}
+		})
+	}
+}
+
+func TestScanKmsgForVictimNegativeFd(t *testing.T) {
+	// A notifier whose /dev/kmsg couldn't be opened stores kmsgFd as -1;
+	// scanning must degrade to zero values rather than erroring.
+	pid, comm := scanKmsgForVictim(-1, "/sys/fs/cgroup/memory/foo")
+	if pid != 0 || comm != "" {
+		t.Errorf("scanKmsgForVictim(-1, ...) = (%d, %q), want (0, \"\")", pid, comm)
+	}
+}
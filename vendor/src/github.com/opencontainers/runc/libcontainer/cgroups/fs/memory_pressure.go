@@ -0,0 +1,317 @@
+// +build linux
+
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// PressureLevel selects which severity a pressure notifier trigger
+// watches. On cgroup v2, which only has two PSI trigger kinds,
+// PressureLevelSome fires as soon as at least one task is stalled on
+// memory and PressureLevelFull fires only once every task in the
+// cgroup is stalled at the same time; PressureLevelMedium has no v2
+// equivalent and registering it against a v2 cgroup returns an error.
+// On cgroup v1, the three levels map directly onto the legacy
+// low/medium/critical severities.
+type PressureLevel int
+
+const (
+	PressureLevelSome PressureLevel = iota
+	PressureLevelMedium
+	PressureLevelFull
+)
+
+func (l PressureLevel) String() string {
+	switch l {
+	case PressureLevelMedium:
+		return "medium"
+	case PressureLevelFull:
+		return "full"
+	default:
+		return "some"
+	}
+}
+
+// v2Trigger returns the memory.pressure trigger keyword for l, or an
+// error if l has no cgroup v2 PSI equivalent.
+func (l PressureLevel) v2Trigger() (string, error) {
+	switch l {
+	case PressureLevelSome:
+		return "some", nil
+	case PressureLevelFull:
+		return "full", nil
+	default:
+		return "", fmt.Errorf("pressure level %v has no cgroup v2 PSI trigger", l)
+	}
+}
+
+// v1LevelName returns the memory.pressure_level severity name for l.
+func (l PressureLevel) v1LevelName() string {
+	switch l {
+	case PressureLevelMedium:
+		return "medium"
+	case PressureLevelFull:
+		return "critical"
+	default:
+		return "low"
+	}
+}
+
+// PressureEvent carries one memory.pressure (cgroup v2) or
+// memory.pressure_level (cgroup v1) notification.
+type PressureEvent struct {
+	Level  PressureLevel
+	Avg10  float64
+	Avg60  float64
+	Avg300 float64
+	// Total is the cumulative stall time, in microseconds, reported
+	// by the PSI line this event came from. It is always zero on
+	// cgroup v1, which has no PSI accounting.
+	Total     uint64
+	StallTime time.Duration
+}
+
+// RegisterPressureNotifier starts watching the memory cgroup at path
+// for pressure stalls at or above level, triggering once total stall
+// time within window exceeds threshold, and returns a channel of
+// events plus a Closer that stops the watch. On cgroup v1, which has
+// no PSI and therefore no threshold/window knobs, threshold and
+// window are ignored and notifications fire on the legacy
+// low/medium/critical boundaries instead. PressureLevelMedium has no
+// cgroup v2 equivalent; registering it against a v2 cgroup returns an
+// error.
+func (s *MemoryGroup) RegisterPressureNotifier(path string, level PressureLevel, threshold, window time.Duration) (<-chan PressureEvent, io.Closer, error) {
+	if s.supportV2 {
+		return registerPressureNotifierV2(path, level, threshold, window)
+	}
+	return registerPressureNotifierV1(path, level)
+}
+
+type pressureNotifier struct {
+	events chan PressureEvent
+	stopFd int
+	fds    []int
+	// ctrlFile is memory.pressure_level (v1 only - v2's registration
+	// keeps memory.pressure reachable via its polling goroutine's
+	// closure instead): kept open via the *os.File, not just its bare
+	// fd, so the GC finalizer never closes it out from under the
+	// kernel's eventfd registration while it's still armed.
+	ctrlFile *os.File
+	once     sync.Once
+	wg       sync.WaitGroup
+	dropped  uint64
+}
+
+// Dropped returns the number of events that could not be delivered
+// because the consumer wasn't receiving from the channel at the
+// instant they were produced.
+func (n *pressureNotifier) Dropped() uint64 {
+	return atomic.LoadUint64(&n.dropped)
+}
+
+// Close stops the epoll/eventfd loop and waits for its goroutine to
+// exit, closes every fd it owns, then closes the event channel and
+// drains any event still buffered in it.
+func (n *pressureNotifier) Close() error {
+	n.once.Do(func() {
+		buf := make([]byte, 8)
+		binaryPutUint64(buf, 1)
+		unix.Write(n.stopFd, buf)
+		n.wg.Wait()
+		for _, fd := range n.fds {
+			unix.Close(fd)
+		}
+		if n.ctrlFile != nil {
+			n.ctrlFile.Close()
+		}
+		close(n.events)
+		for range n.events {
+		}
+	})
+	return nil
+}
+
+func binaryPutUint64(b []byte, v uint64) {
+	for i := 0; i < 8; i++ {
+		b[i] = byte(v >> (8 * uint(i)))
+	}
+}
+
+// formatV2Trigger renders the "some|full <threshold_us> <window_us>"
+// line written to memory.pressure to arm a poll trigger.
+func formatV2Trigger(level PressureLevel, threshold, window time.Duration) (string, error) {
+	trigger, err := level.v2Trigger()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %d %d", trigger, threshold.Microseconds(), window.Microseconds()), nil
+}
+
+func registerPressureNotifierV2(path string, level PressureLevel, threshold, window time.Duration) (<-chan PressureEvent, io.Closer, error) {
+	triggerLine, err := formatV2Trigger(level, threshold, window)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	triggerFile := filepath.Join(path, "memory.pressure")
+	f, err := os.OpenFile(triggerFile, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := f.WriteString(triggerLine); err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("failed to arm %s with trigger %q: %v", triggerFile, triggerLine, err)
+	}
+
+	epfd, stopFd, err := newEpollWithStop(int(f.Fd()), unix.EPOLLPRI)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	n := &pressureNotifier{
+		events: make(chan PressureEvent, 1),
+		stopFd: stopFd,
+		fds:    []int{epfd, stopFd, int(f.Fd())},
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		epollLoop(epfd, int(f.Fd()), stopFd, func() {
+			ev, err := readPressureFile(f, level)
+			if err != nil {
+				return
+			}
+			select {
+			case n.events <- ev:
+			default:
+				atomic.AddUint64(&n.dropped, 1)
+			}
+		})
+	}()
+
+	return n.events, n, nil
+}
+
+// readPressureFile re-reads memory.pressure from the start and parses
+// the "some"/"full" PSI line matching level, e.g.:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func readPressureFile(f *os.File, level PressureLevel) (PressureEvent, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return PressureEvent{}, err
+	}
+	want := level.String()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || fields[0] != want {
+			continue
+		}
+		ev := PressureEvent{Level: level}
+		for _, kv := range fields[1:] {
+			k, v, ok := cutKeyValue(kv, "=")
+			if !ok {
+				continue
+			}
+			switch k {
+			case "avg10":
+				ev.Avg10, _ = strconv.ParseFloat(v, 64)
+			case "avg60":
+				ev.Avg60, _ = strconv.ParseFloat(v, 64)
+			case "avg300":
+				ev.Avg300, _ = strconv.ParseFloat(v, 64)
+			case "total":
+				ev.Total, _ = strconv.ParseUint(v, 10, 64)
+				ev.StallTime = time.Duration(ev.Total) * time.Microsecond
+			}
+		}
+		return ev, nil
+	}
+	return PressureEvent{}, fmt.Errorf("memory.pressure: no %q line", want)
+}
+
+func cutKeyValue(s, sep string) (string, string, bool) {
+	i := strings.Index(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// formatV1EventControl renders the "<eventfd> <pressure_level_fd>
+// low|medium|critical" line written to cgroup.event_control to
+// register for memory.pressure_level notifications.
+func formatV1EventControl(eventFd, levelFd uintptr, level PressureLevel) string {
+	return fmt.Sprintf("%d %d %s", eventFd, levelFd, level.v1LevelName())
+}
+
+// registerPressureNotifierV1 implements the legacy cgroup v1 fallback:
+// register an eventfd against memory.pressure_level via
+// cgroup.event_control, per
+// https://www.kernel.org/doc/Documentation/cgroup-v1/memory.txt.
+func registerPressureNotifierV1(path string, level PressureLevel) (<-chan PressureEvent, io.Closer, error) {
+	levelFile, err := os.Open(filepath.Join(path, "memory.pressure_level"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	eventFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		levelFile.Close()
+		return nil, nil, err
+	}
+
+	controlPath := filepath.Join(path, "cgroup.event_control")
+	config := formatV1EventControl(uintptr(eventFd), levelFile.Fd(), level)
+	if err := writeFile(path, "cgroup.event_control", config); err != nil {
+		unix.Close(eventFd)
+		levelFile.Close()
+		return nil, nil, fmt.Errorf("failed to write %s: %v", controlPath, err)
+	}
+
+	epfd, stopFd, err := newEpollWithStop(eventFd, unix.EPOLLIN)
+	if err != nil {
+		unix.Close(eventFd)
+		levelFile.Close()
+		return nil, nil, err
+	}
+
+	n := &pressureNotifier{
+		events:   make(chan PressureEvent, 1),
+		stopFd:   stopFd,
+		fds:      []int{epfd, stopFd, eventFd},
+		ctrlFile: levelFile,
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		buf := make([]byte, 8)
+		epollLoop(epfd, eventFd, stopFd, func() {
+			unix.Read(eventFd, buf)
+			select {
+			case n.events <- PressureEvent{Level: level}:
+			default:
+				atomic.AddUint64(&n.dropped, 1)
+			}
+		})
+	}()
+
+	return n.events, n, nil
+}
@@ -0,0 +1,120 @@
+// +build linux
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFormatV2Trigger(t *testing.T) {
+	cases := []struct {
+		level   PressureLevel
+		want    string
+		wantErr bool
+	}{
+		{level: PressureLevelSome, want: "some 500000 1000000"},
+		{level: PressureLevelFull, want: "full 500000 1000000"},
+		{level: PressureLevelMedium, wantErr: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.level.String(), func(t *testing.T) {
+			got, err := formatV2Trigger(c.level, 500*time.Millisecond, time.Second)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != c.want {
+				t.Errorf("formatV2Trigger = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestFormatV1EventControl(t *testing.T) {
+	cases := []struct {
+		level PressureLevel
+		want  string
+	}{
+		{level: PressureLevelSome, want: "7 9 low"},
+		{level: PressureLevelMedium, want: "7 9 medium"},
+		{level: PressureLevelFull, want: "7 9 critical"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.level.String(), func(t *testing.T) {
+			got := formatV1EventControl(7, 9, c.level)
+			if got != c.want {
+				t.Errorf("formatV1EventControl = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestPressureLevelV1LevelName(t *testing.T) {
+	cases := []struct {
+		level PressureLevel
+		want  string
+	}{
+		{PressureLevelSome, "low"},
+		{PressureLevelMedium, "medium"},
+		{PressureLevelFull, "critical"},
+	}
+	for _, c := range cases {
+		if got := c.level.v1LevelName(); got != c.want {
+			t.Errorf("%v.v1LevelName() = %q, want %q", c.level, got, c.want)
+		}
+	}
+}
+
+func TestPressureLevelString(t *testing.T) {
+	cases := []struct {
+		level PressureLevel
+		want  string
+	}{
+		{PressureLevelSome, "some"},
+		{PressureLevelMedium, "medium"},
+		{PressureLevelFull, "full"},
+	}
+	for _, c := range cases {
+		if got := c.level.String(); got != c.want {
+			t.Errorf("%v.String() = %q, want %q", int(c.level), got, c.want)
+		}
+	}
+}
+
+func TestReadPressureFile(t *testing.T) {
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	helper.writeFileContents(map[string]string{
+		"memory.pressure": `some avg10=1.50 avg60=2.50 avg300=3.50 total=1000000
+full avg10=0.50 avg60=0.75 avg300=1.00 total=500000
+`,
+	})
+
+	f, err := os.Open(filepath.Join(helper.CgroupPath, "memory.pressure"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ev, err := readPressureFile(f, PressureLevelFull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Avg10 != 0.50 || ev.Avg60 != 0.75 || ev.Avg300 != 1.00 || ev.Total != 500000 {
+		t.Fatalf("unexpected PressureEvent: %+v", ev)
+	}
+	if ev.StallTime.Microseconds() != 500000 {
+		t.Errorf("StallTime = %v, want 500ms", ev.StallTime)
+	}
+}
@@ -0,0 +1,439 @@
+// +build linux
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/opencontainers/runc/libcontainer/cgroups"
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+func TestMemoryOOMKillCountV1(t *testing.T) {
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	helper.writeFileContents(map[string]string{
+		"memory.oom_control": `oom_kill_disable 0
+under_oom 0
+oom_kill 3
+`,
+	})
+
+	memory := &MemoryGroup{}
+	count, err := memory.OOMKillCount(helper.CgroupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("expected OOMKillCount 3, got %d", count)
+	}
+}
+
+func TestMemoryOOMKillCountV1NoField(t *testing.T) {
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	// Older kernels expose oom_control without an oom_kill field.
+	helper.writeFileContents(map[string]string{
+		"memory.oom_control": `oom_kill_disable 0
+under_oom 0
+`,
+	})
+
+	memory := &MemoryGroup{}
+	count, err := memory.OOMKillCount(helper.CgroupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected OOMKillCount 0, got %d", count)
+	}
+}
+
+func TestMemoryOOMKillCountV1Missing(t *testing.T) {
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	memory := &MemoryGroup{}
+	count, err := memory.OOMKillCount(helper.CgroupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected OOMKillCount 0 for missing file, got %d", count)
+	}
+}
+
+func TestMemoryOOMKillCountV2(t *testing.T) {
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	helper.writeFileContents(map[string]string{
+		"memory.events": `low 0
+high 0
+max 0
+oom 2
+oom_kill 2
+`,
+	})
+
+	memory := &MemoryGroup{supportV2: true}
+	count, err := memory.OOMKillCount(helper.CgroupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected OOMKillCount 2, got %d", count)
+	}
+}
+
+func TestSetMemoryAndSwapV1(t *testing.T) {
+	cases := []struct {
+		name       string
+		curMemory  int64
+		curSwap    int64
+		memory     int64
+		swap       int64
+		wantMemory int64
+		wantSwap   int64
+	}{
+		{
+			name:       "grow both",
+			curMemory:  100,
+			curSwap:    200,
+			memory:     300,
+			swap:       400,
+			wantMemory: 300,
+			wantSwap:   400,
+		},
+		{
+			name:       "shrink both",
+			curMemory:  300,
+			curSwap:    400,
+			memory:     100,
+			swap:       200,
+			wantMemory: 100,
+			wantSwap:   200,
+		},
+		{
+			name:       "equal to current",
+			curMemory:  100,
+			curSwap:    200,
+			memory:     100,
+			swap:       200,
+			wantMemory: 100,
+			wantSwap:   200,
+		},
+		{
+			name:       "unlimited",
+			curMemory:  100,
+			curSwap:    200,
+			memory:     -1,
+			swap:       -1,
+			wantMemory: -1,
+			wantSwap:   -1,
+		},
+		{
+			name:       "grow memory past stale swap, swap untouched",
+			curMemory:  100,
+			curSwap:    200,
+			memory:     300,
+			swap:       0,
+			wantMemory: 300,
+			wantSwap:   200,
+		},
+		{
+			name:       "shrink swap below stale memory, memory untouched",
+			curMemory:  300,
+			curSwap:    400,
+			memory:     0,
+			swap:       200,
+			wantMemory: 300,
+			wantSwap:   200,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			helper := newCgroupTestUtil(t)
+			defer helper.cleanup()
+
+			helper.writeFileContents(map[string]string{
+				"memory.limit_in_bytes":       strconv.FormatInt(c.curMemory, 10),
+				"memory.memsw.limit_in_bytes": strconv.FormatInt(c.curSwap, 10),
+			})
+
+			memory := &MemoryGroup{}
+			cgroup := &configs.Cgroup{
+				Resources: &configs.Resources{
+					Memory:     c.memory,
+					MemorySwap: c.swap,
+				},
+			}
+			if err := memory.setMemoryAndSwap(helper.CgroupPath, cgroup); err != nil {
+				t.Fatal(err)
+			}
+
+			gotMemory, err := getCgroupParamUint(helper.CgroupPath, "memory.limit_in_bytes")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(gotMemory) != c.wantMemory {
+				t.Errorf("memory.limit_in_bytes = %d, want %d", gotMemory, c.wantMemory)
+			}
+
+			gotSwap, err := getCgroupParamUint(helper.CgroupPath, "memory.memsw.limit_in_bytes")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(gotSwap) != c.wantSwap {
+				t.Errorf("memory.memsw.limit_in_bytes = %d, want %d", gotSwap, c.wantSwap)
+			}
+		})
+	}
+}
+
+func TestSetMemoryAndSwapV1SwapOnlyWrite(t *testing.T) {
+	// Regression test: when only swap is being changed (memory is left
+	// at 0, a no-op), the swap write itself must still be made, even
+	// though it shrinks swap below the memory limit in effect. The fake
+	// hierarchy never rejects a write with EINVAL, so the retry path is
+	// not exercised here.
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	helper.writeFileContents(map[string]string{
+		"memory.limit_in_bytes":       "10",
+		"memory.memsw.limit_in_bytes": "20",
+	})
+
+	memory := &MemoryGroup{}
+	cgroup := &configs.Cgroup{
+		Resources: &configs.Resources{
+			Memory:     0,
+			MemorySwap: 5,
+		},
+	}
+	if err := memory.setMemoryAndSwap(helper.CgroupPath, cgroup); err != nil {
+		t.Fatal(err)
+	}
+
+	gotSwap, err := getCgroupParamUint(helper.CgroupPath, "memory.memsw.limit_in_bytes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotSwap != 5 {
+		t.Fatalf("memory.memsw.limit_in_bytes = %d, want 5", gotSwap)
+	}
+}
+
+func TestSetMemoryAndSwapV2(t *testing.T) {
+	cases := []struct {
+		name     string
+		memory   int64
+		swap     int64
+		wantMax  string
+		wantSwap string
+		wantErr  bool
+	}{
+		{name: "grow", memory: 300, swap: 400, wantMax: "300", wantSwap: "100"},
+		{name: "shrink", memory: 100, swap: 150, wantMax: "100", wantSwap: "50"},
+		{name: "equal", memory: 100, swap: 100, wantMax: "100", wantSwap: "0"},
+		{name: "unlimited swap", memory: 100, swap: -1, wantMax: "100", wantSwap: "max"},
+		{name: "swap less than memory is an error", memory: 200, swap: 100, wantErr: true},
+		{name: "memory only, swap left alone", memory: 100, swap: 0, wantMax: "100"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			helper := newCgroupTestUtil(t)
+			defer helper.cleanup()
+
+			memory := &MemoryGroup{supportV2: true}
+			cgroup := &configs.Cgroup{
+				Resources: &configs.Resources{
+					Memory:     c.memory,
+					MemorySwap: c.swap,
+				},
+			}
+			err := memory.setMemoryAndSwap(helper.CgroupPath, cgroup)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotMax := helper.readFileString("memory.max")
+			if gotMax != c.wantMax {
+				t.Errorf("memory.max = %q, want %q", gotMax, c.wantMax)
+			}
+
+			if c.wantSwap != "" {
+				gotSwap := helper.readFileString("memory.swap.max")
+				if gotSwap != c.wantSwap {
+					t.Errorf("memory.swap.max = %q, want %q", gotSwap, c.wantSwap)
+				}
+			}
+		})
+	}
+}
+
+func TestPrimeKernelMemoryAccounting(t *testing.T) {
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	helper.writeFileContents(map[string]string{
+		"memory.kmem.limit_in_bytes": "0",
+	})
+
+	if err := primeKernelMemoryAccounting(helper.CgroupPath, &configs.Resources{}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := helper.readFileString("memory.kmem.limit_in_bytes")
+	if got != "-1" {
+		t.Fatalf("memory.kmem.limit_in_bytes = %q, want \"-1\" after priming", got)
+	}
+}
+
+func TestPrimeKernelMemoryAccountingSkippedWhenExplicit(t *testing.T) {
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	// No memory.kmem.limit_in_bytes fixture: writes to the fake hierarchy
+	// create the file, so it still being absent afterwards proves the
+	// explicit-KernelMemory skip took effect.
+	if err := primeKernelMemoryAccounting(helper.CgroupPath, &configs.Resources{KernelMemory: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(helper.CgroupPath, "memory.kmem.limit_in_bytes")); !os.IsNotExist(err) {
+		t.Fatalf("memory.kmem.limit_in_bytes was written despite an explicit KernelMemory (stat err: %v)", err)
+	}
+}
+
+func TestPrimeKernelMemoryAccountingTCP(t *testing.T) {
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	helper.writeFileContents(map[string]string{
+		"memory.kmem.limit_in_bytes":     "5",
+		"memory.kmem.tcp.limit_in_bytes": "0",
+	})
+
+	if err := primeKernelMemoryAccounting(helper.CgroupPath, &configs.Resources{KernelMemory: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := helper.readFileString("memory.kmem.limit_in_bytes"); got != "5" {
+		t.Errorf("memory.kmem.limit_in_bytes = %q, want \"5\" (untouched, Set already wrote the explicit value)", got)
+	}
+	if got := helper.readFileString("memory.kmem.tcp.limit_in_bytes"); got != "-1" {
+		t.Errorf("memory.kmem.tcp.limit_in_bytes = %q, want \"-1\" after priming", got)
+	}
+}
+
+func TestWriteKmemFileTolerance(t *testing.T) {
+	// writeKmemFile must tolerate a missing control file (kernel built
+	// without CONFIG_MEMCG_KMEM) rather than erroring. Writes to the fake
+	// hierarchy create missing files, so point it at a directory that
+	// doesn't exist to get a real ENOENT.
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	if err := writeKmemFile(filepath.Join(helper.CgroupPath, "missing"), "memory.kmem.limit_in_bytes", "1"); err != nil {
+		t.Fatalf("expected writeKmemFile to tolerate ENOENT, got %v", err)
+	}
+}
+
+func TestSetExplicitKernelMemoryPropagatesErrors(t *testing.T) {
+	// Unlike the priming writes, Set must propagate an error writing an
+	// explicit KernelMemory limit rather than silently tolerating it:
+	// the control file path is a directory here, so the write fails and
+	// Set should surface that, not report success. (A merely missing
+	// file would not do: writes to the fake hierarchy create it.)
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	if err := os.Mkdir(filepath.Join(helper.CgroupPath, "memory.kmem.limit_in_bytes"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	memory := &MemoryGroup{}
+	cgroup := &configs.Cgroup{
+		Resources: &configs.Resources{
+			KernelMemory:     100,
+			MemorySwappiness: -1,
+		},
+	}
+	if err := memory.Set(helper.CgroupPath, cgroup); err == nil {
+		t.Fatal("expected Set to propagate the missing memory.kmem.limit_in_bytes error, got nil")
+	}
+}
+
+func TestGetStatsV2MemoryEvents(t *testing.T) {
+	helper := newCgroupTestUtil(t)
+	defer helper.cleanup()
+
+	helper.writeFileContents(map[string]string{
+		"memory.events": `low 1
+high 2
+max 3
+oom 4
+oom_kill 5
+`,
+		"memory.stat": `anon 10
+file 20
+kernel_stack 30
+slab 40
+sock 50
+shmem 60
+pgfault 70
+pgmajfault 80
+workingset_refault 90
+workingset_activate 100
+`,
+		"memory.current":      "0",
+		"memory.swap.current": "0",
+	})
+
+	memory := &MemoryGroup{supportV2: true}
+	stats := &cgroups.Stats{MemoryStats: cgroups.MemoryStats{Stats: map[string]uint64{}}}
+	if err := memory.GetStats(helper.CgroupPath, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	me := stats.MemoryStats.MemoryEvents
+	if me.Low != 1 || me.High != 2 || me.Max != 3 || me.OOM != 4 || me.OOMKill != 5 {
+		t.Fatalf("unexpected MemoryEvents: %+v", me)
+	}
+	if stats.MemoryStats.OOMKillCount != 5 {
+		t.Fatalf("OOMKillCount = %d, want 5", stats.MemoryStats.OOMKillCount)
+	}
+
+	want := map[string]uint64{
+		"Anon": 10, "File": 20, "KernelStack": 30, "Slab": 40, "Sock": 50,
+		"Shmem": 60, "Pgfault": 70, "Pgmajfault": 80,
+		"WorkingsetRefault": 90, "WorkingsetActivate": 100,
+	}
+	got := map[string]uint64{
+		"Anon": stats.MemoryStats.Anon, "File": stats.MemoryStats.File,
+		"KernelStack": stats.MemoryStats.KernelStack, "Slab": stats.MemoryStats.Slab,
+		"Sock": stats.MemoryStats.Sock, "Shmem": stats.MemoryStats.Shmem,
+		"Pgfault": stats.MemoryStats.Pgfault, "Pgmajfault": stats.MemoryStats.Pgmajfault,
+		"WorkingsetRefault": stats.MemoryStats.WorkingsetRefault,
+		"WorkingsetActivate": stats.MemoryStats.WorkingsetActivate,
+	}
+	for k, w := range want {
+		if got[k] != w {
+			t.Errorf("%s = %d, want %d", k, got[k], w)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// +build linux
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// cgroupTestUtil sets up a tempdir-backed fake cgroup hierarchy so
+// MemoryGroup methods can be exercised without a real cgroupfs mount.
+type cgroupTestUtil struct {
+	CgroupData *cgroupData
+	CgroupPath string
+	t          *testing.T
+}
+
+func newCgroupTestUtil(t *testing.T) *cgroupTestUtil {
+	d := &cgroupData{
+		config: &configs.Cgroup{
+			Resources: &configs.Resources{},
+		},
+	}
+	tempPath, err := ioutil.TempDir("", "cgroup_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCgroupPath := filepath.Join(tempPath, "cgroup_test")
+	if err := os.MkdirAll(testCgroupPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	d.root = tempPath
+
+	return &cgroupTestUtil{CgroupData: d, CgroupPath: testCgroupPath, t: t}
+}
+
+func (c *cgroupTestUtil) cleanup() {
+	os.RemoveAll(c.CgroupData.root)
+}
+
+func (c *cgroupTestUtil) writeFileContents(fileContents map[string]string) {
+	for file, contents := range fileContents {
+		if err := writeFile(c.CgroupPath, file, contents); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+}
+
+// readFileString reads and trims a single control file under the fake
+// cgroup path, failing the test on any error.
+func (c *cgroupTestUtil) readFileString(file string) string {
+	data, err := ioutil.ReadFile(filepath.Join(c.CgroupPath, file))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}